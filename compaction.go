@@ -0,0 +1,18 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+// elideTombstone reports whether a range deletion tombstone or a deleted
+// key at seqNum can be dropped during compaction because no snapshot still
+// needs to observe it. A key is only safe to drop once it predates every
+// live snapshot; d.mu.snapshots.oldest() is the smallest seqNum still being
+// read from, so a deletion strictly older than it is already visible to
+// every live snapshot, and no snapshot can still read a key it shadows.
+func (d *DB) elideTombstone(seqNum uint64) bool {
+	d.mu.Lock()
+	oldest := d.mu.snapshots.oldest()
+	d.mu.Unlock()
+	return seqNum < oldest
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// Get gets the value for the given key. It returns ErrNotFound if the DB
+// does not contain the key.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (d *DB) Get(key []byte) ([]byte, error) {
+	return d.getInternal(key, d.mu.versions.logSeqNum)
+}
+
+// getInternal walks the levels of current from newest to oldest looking for
+// key as of seqNum, consulting each level's bloom filters and range
+// deletion tombstones via levelIter before ever opening a candidate
+// sstable.
+func (d *DB) getInternal(key []byte, seqNum uint64) ([]byte, error) {
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+
+	// Levels are assumed sorted and non-overlapping here, which holds for
+	// every level but L0; an L0 sublevel split is outside the scope of this
+	// file and would change only how files for level 0 is built below.
+	opts := &db.IterOptions{SeqNum: seqNum}
+	for level := 0; level < len(current.levels); level++ {
+		files := current.levels[level].files
+		if len(files) == 0 {
+			continue
+		}
+
+		l := newLevelIter(opts, d.cmp, d.tableCache.newIters, files)
+		l.initRangeDel(d.tableCache.newRangeDelIter, &current.rangeDelLevels[level])
+		// A higher level's tombstones can shadow an entire candidate sstable
+		// at this level, letting loadFile skip it without opening it.
+		l.initSkipRangeDel(current.rangeDelIterAbove(level))
+		// The bloom filter lets SeekGEPoint rule out most candidate sstables
+		// without a table cache fill or block read.
+		l.initTableFilter(d.tableCache.mayContain)
+
+		l.SeekGEPoint(key)
+		if err := l.Error(); err != nil {
+			l.Close()
+			return nil, err
+		}
+		if l.Valid() && d.cmp(l.Key().UserKey, key) == 0 {
+			value := append([]byte(nil), l.Value()...)
+			kind := l.Key().Kind()
+			l.Close()
+			if kind == db.InternalKeyKindDelete {
+				return nil, db.ErrNotFound
+			}
+			return value, nil
+		}
+		if err := l.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, db.ErrNotFound
+}
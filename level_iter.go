@@ -40,6 +40,34 @@ type levelIter struct {
 	rangeDel        *rangeDelLevel
 	files           []fileMetadata
 	err             error
+	// skipRangeDel is a cursor over the range deletion tombstones
+	// accumulated from levels above this one, fragmented and sorted by
+	// start key. loadFile consults it to detect that a candidate sstable's
+	// entire key range is shadowed by higher-level tombstones, allowing the
+	// table to be skipped without being opened. It is nil unless
+	// initSkipRangeDel has been called.
+	skipRangeDel internalIterator
+	// prefetch holds the in-flight result of speculatively opening
+	// files[prefetchIndex] on a background goroutine while the file at
+	// l.index is still being scanned. It is populated only when
+	// opts.Prefetch is set, and only for the file a sequential Next/Prev
+	// would load next, since that is the only position that can be
+	// predicted ahead of time.
+	prefetch      chan prefetchResult
+	prefetchIndex int
+	// tableMayContain, when non-nil, consults a candidate sstable's bloom
+	// filter without opening the table. It is used by SeekGEPoint to avoid
+	// paying for a table cache fill and block read on a point lookup the
+	// filter can already rule out.
+	tableMayContain func(f *fileMetadata, key []byte) bool
+}
+
+// prefetchResult is the outcome of speculatively opening an sstable and, if
+// range deletions are in use, its range deletion iterator.
+type prefetchResult struct {
+	iter         internalIterator
+	rangeDelIter internalIterator
+	err          error
 }
 
 // levelIter implements the internalIterator interface.
@@ -68,6 +96,87 @@ func (l *levelIter) initRangeDel(newRangeDelIter tableNewIter, rangeDel *rangeDe
 	l.rangeDel = rangeDel
 }
 
+// initSkipRangeDel supplies a cursor over the merged range deletion
+// tombstones from levels above this one. The cursor must be positioned by
+// seeking and must return tombstones in start-key order via Key() (the
+// start, inclusive) and Value() (the end, exclusive). loadFile uses it to
+// skip sstables that are entirely covered by those tombstones.
+func (l *levelIter) initSkipRangeDel(skipRangeDel internalIterator) {
+	l.skipRangeDel = skipRangeDel
+}
+
+// initTableFilter supplies a callback consulted by SeekGEPoint to test a
+// candidate sstable's bloom filter before it is opened. mayContain must
+// return false only when key is definitely absent from f.
+func (l *levelIter) initTableFilter(mayContain func(f *fileMetadata, key []byte) bool) {
+	l.tableMayContain = mayContain
+}
+
+// tableShadowed reports whether f's entire key range is covered by one or
+// more range deletion tombstones from higher levels that postdate every key
+// in f. It positions l.skipRangeDel at the tombstone that covers (or would
+// cover) f's smallest key and walks forward, joining adjacent or
+// overlapping tombstones, until the joined cover either subsumes
+// [smallest, largest] or a gap is found.
+func (l *levelIter) tableShadowed(f *fileMetadata) bool {
+	if l.skipRangeDel == nil {
+		return false
+	}
+
+	// The common case is a single higher-level tombstone spanning several
+	// consecutive lower-level files, so the tombstone covering f.smallest
+	// may have started in an earlier file. Back up to the last tombstone
+	// starting before f.smallest first; a forward-only SeekGE would
+	// skip over it and the file would never be recognized as shadowed.
+	l.skipRangeDel.SeekLT(f.smallest.UserKey)
+	if !l.skipRangeDel.Valid() {
+		l.skipRangeDel.First()
+	} else if l.cmp(l.skipRangeDel.Value(), f.smallest.UserKey) <= 0 {
+		// That tombstone's exclusive end doesn't reach f.smallest, so it
+		// can't be the start of the cover. Resume from the first tombstone
+		// starting at or after f.smallest instead.
+		l.skipRangeDel.Next()
+	}
+
+	covered := f.smallest.UserKey
+	for l.skipRangeDel.Valid() {
+		start := l.skipRangeDel.Key()
+		if seqNum := l.opts.GetSeqNum(); seqNum != 0 && start.SeqNum() > seqNum {
+			// The tombstone postdates the snapshot under which f is being
+			// read and so is invisible to it; it cannot shadow f.
+			l.skipRangeDel.Next()
+			continue
+		}
+		if start.SeqNum() <= f.largestSeqNum {
+			// This tombstone cannot be proven to postdate every key in f, so
+			// it cannot be used to shadow the table. f.largestSeqNum is the
+			// true maximum sequence number of any key in f -- unlike
+			// f.largest.SeqNum(), which is only the seqnum of whichever key
+			// happens to be the user-key maximum (e.g. a range deletion
+			// boundary sentinel with an unrelated seqnum). Tombstones are
+			// visited in start-key order, but not necessarily in
+			// sequence-number order, so keep looking rather than bailing out.
+			l.skipRangeDel.Next()
+			continue
+		}
+		if l.cmp(start.UserKey, covered) > 0 {
+			// There is a gap between the key range covered so far and the
+			// start of this tombstone, so f is not fully shadowed.
+			return false
+		}
+		if end := l.skipRangeDel.Value(); l.cmp(end, covered) > 0 {
+			covered = end
+		}
+		// The tombstone end is exclusive, so covered must extend strictly
+		// past f.largest.UserKey to shadow it.
+		if l.cmp(covered, f.largest.UserKey) > 0 {
+			return true
+		}
+		l.skipRangeDel.Next()
+	}
+	return false
+}
+
 func (l *levelIter) findFileGE(key []byte) int {
 	// Find the earliest file whose largest key is >= ikey.
 	return sort.Search(len(l.files), func(i int) bool {
@@ -83,7 +192,15 @@ func (l *levelIter) findFileLT(key []byte) int {
 	return index - 1
 }
 
-func (l *levelIter) loadFile(index, dir int) bool {
+// loadFile loads the file at index, advancing in direction dir if that file
+// must be skipped. sequential must be true only when the caller is
+// advancing through the level in key order one file at a time (Next, Prev,
+// and the skipEmptyFile* helpers they drive) -- that is the only access
+// pattern where the following file is worth prefetching. Seek-style entry
+// points (SeekGE, SeekGEPoint, SeekLT, First, Last), including the one-shot
+// lookup used by Get, pass false so that a point lookup doesn't pay for
+// opening an sstable it will never consume.
+func (l *levelIter) loadFile(index, dir int, sequential bool) bool {
 	l.boundary = nil
 	if l.index == index {
 		return l.iter != nil
@@ -99,13 +216,21 @@ func (l *levelIter) loadFile(index, dir int) bool {
 	for ; ; index += dir {
 		l.index = index
 		if l.index < 0 || l.index >= len(l.files) {
+			l.cancelPrefetch()
 			return false
 		}
+		if l.prefetch != nil && l.index != l.prefetchIndex {
+			// The candidate index drifted away from what was prefetched
+			// (bounds or shadowing caused loadFile to skip ahead). The
+			// in-flight result is no longer useful.
+			l.cancelPrefetch()
+		}
 
 		f := &l.files[l.index]
 		if lowerBound := l.opts.GetLowerBound(); lowerBound != nil {
 			if l.cmp(f.largest.UserKey, lowerBound) < 0 {
 				// The largest key in the sstable is smaller than the lower bound.
+				l.cancelPrefetch()
 				if dir < 0 {
 					return false
 				}
@@ -116,6 +241,7 @@ func (l *levelIter) loadFile(index, dir int) bool {
 			if l.cmp(f.smallest.UserKey, upperBound) >= 0 {
 				// The smallest key in the sstable is greater than or equal to the
 				// lower bound.
+				l.cancelPrefetch()
 				if dir > 0 {
 					return false
 				}
@@ -123,9 +249,42 @@ func (l *levelIter) loadFile(index, dir int) bool {
 			}
 		}
 
-		if l.rangeDel != nil {
-			// TODO(peter,rangedel): If the table is entirely covered by a range
-			// deletion tombstone, skip it.
+		if seqNum := l.opts.GetSeqNum(); seqNum != 0 && f.smallestSeqNum > seqNum {
+			// Every key in f was written after the snapshot was taken, so
+			// none of them are visible. f.smallestSeqNum is the true
+			// minimum sequence number of any key in f -- unlike
+			// f.smallest.SeqNum(), which is only the seqnum of whichever
+			// key happens to be the user-key minimum (e.g. a range
+			// deletion boundary sentinel with an unrelated seqnum).
+			// Unlike the bounds checks above, files aren't ordered by
+			// sequence number, so there's no early return here: just keep
+			// walking in the iteration direction.
+			l.cancelPrefetch()
+			continue
+		}
+
+		if l.rangeDel != nil && l.tableShadowed(f) {
+			// The table is entirely covered by range deletion tombstones
+			// from higher levels, so none of its keys are visible. Skip it
+			// without opening it.
+			l.cancelPrefetch()
+			continue
+		}
+
+		if l.prefetch != nil && l.index == l.prefetchIndex {
+			res := <-l.prefetch
+			l.prefetch = nil
+			l.iter, l.err = res.iter, res.err
+			if l.err != nil || l.iter == nil {
+				return false
+			}
+			if l.rangeDel != nil {
+				l.rangeDel.init(res.rangeDelIter)
+			}
+			if sequential {
+				l.maybePrefetch(dir)
+			}
+			return true
 		}
 
 		l.iter, l.err = l.newIter(f)
@@ -140,23 +299,138 @@ func (l *levelIter) loadFile(index, dir int) bool {
 			}
 			l.rangeDel.init(iter)
 		}
+		if sequential {
+			l.maybePrefetch(dir)
+		}
 		return true
 	}
 }
 
+// maybePrefetch speculatively opens files[l.index+dir] on a background
+// goroutine when opts.Prefetch is set, so that a subsequent sequential
+// loadFile call for that index can hand off to an already-open iterator
+// instead of waiting on the table cache and block reads.
+func (l *levelIter) maybePrefetch(dir int) {
+	if !l.opts.Prefetch || l.prefetch != nil {
+		return
+	}
+	next := l.index + dir
+	if next < 0 || next >= len(l.files) {
+		return
+	}
+
+	f := &l.files[next]
+	ch := make(chan prefetchResult, 1)
+	l.prefetch = ch
+	l.prefetchIndex = next
+	go func() {
+		var res prefetchResult
+		res.iter, res.err = l.newIter(f)
+		if res.err == nil && l.rangeDel != nil {
+			res.rangeDelIter, res.err = l.newRangeDelIter(f)
+		}
+		ch <- res
+	}()
+}
+
+// cancelPrefetch discards any in-flight prefetch, closing its iterators
+// once the background goroutine completes so that an abandoned prefetch
+// never leaks an open sstable. It returns without waiting for that close to
+// happen, since it's called from the scanning hot path (seeks, bounds and
+// snapshot rejections) where stalling on a table cache fill would defeat
+// the point of prefetching. Close, in contrast, does wait -- see there.
+func (l *levelIter) cancelPrefetch() {
+	if l.prefetch == nil {
+		return
+	}
+	ch := l.prefetch
+	l.prefetch = nil
+	go func() {
+		res := <-ch
+		if res.iter != nil {
+			_ = res.iter.Close()
+		}
+		if res.rangeDelIter != nil {
+			_ = res.rangeDelIter.Close()
+		}
+	}()
+}
+
 func (l *levelIter) SeekGE(key []byte) {
 	// NB: the top-level dbIter has already adjusted key based on
 	// IterOptions.LowerBound.
-	if l.loadFile(l.findFileGE(key), 1) {
+	if l.loadFile(l.findFileGE(key), 1, false) {
+		l.iter.SeekGE(key)
+		l.skipEmptyFileForward()
+	}
+}
+
+// SeekGEPoint is a point-lookup fast path used by DB.Get (through
+// getInternal) in place of SeekGE. Starting from the first file that could
+// contain key, it consults each candidate's bloom filter and skips over any
+// file the filter guarantees does not contain key, advancing past it
+// without opening it. A file is never skipped this way if it carries a
+// range deletion tombstone that could cover key: a bloom filter only
+// indexes point keys, so a tombstone buried in the middle of an otherwise
+// ordinary file (not at its smallest/largest boundary) would otherwise be
+// missed, letting an older value for key from a lower level show through
+// even though the tombstone deletes it.
+func (l *levelIter) SeekGEPoint(key []byte) {
+	index := l.findFileGE(key)
+	for l.tableMayContain != nil && index < len(l.files) {
+		f := &l.files[index]
+		if l.tableMayContain(f, key) {
+			break
+		}
+		if l.rangeDel != nil {
+			covers, err := l.fileRangeDelCovers(f, key)
+			if err != nil {
+				l.err = err
+				break
+			}
+			if covers {
+				break
+			}
+		}
+		index++
+	}
+	if l.loadFile(index, 1, false) {
 		l.iter.SeekGE(key)
 		l.skipEmptyFileForward()
 	}
 }
 
+// fileRangeDelCovers reports whether any range deletion tombstone in f
+// covers key. It is used by SeekGEPoint to decide whether a file the bloom
+// filter says doesn't contain key as a point entry can still be skipped, or
+// whether it must be opened because one of its tombstones might shadow key
+// from a lower level.
+func (l *levelIter) fileRangeDelCovers(f *fileMetadata, key []byte) (bool, error) {
+	if l.newRangeDelIter == nil {
+		return false, nil
+	}
+	iter, err := l.newRangeDelIter(f)
+	if err != nil {
+		return false, err
+	}
+	if iter == nil {
+		return false, nil
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		start, end := iter.Key(), iter.Value()
+		if l.cmp(start.UserKey, key) <= 0 && l.cmp(key, end) < 0 {
+			return true, nil
+		}
+	}
+	return false, iter.Error()
+}
+
 func (l *levelIter) SeekLT(key []byte) {
 	// NB: the top-level dbIter has already adjusted key based on
 	// IterOptions.UpperBound.
-	if l.loadFile(l.findFileLT(key), -1) {
+	if l.loadFile(l.findFileLT(key), -1, false) {
 		l.iter.SeekLT(key)
 		l.skipEmptyFileBackward()
 	}
@@ -165,7 +439,7 @@ func (l *levelIter) SeekLT(key []byte) {
 func (l *levelIter) First() {
 	// NB: the top-level dbIter will call SeekGE if IterOptions.LowerBound is
 	// set.
-	if l.loadFile(0, 1) {
+	if l.loadFile(0, 1, false) {
 		l.iter.First()
 		l.skipEmptyFileForward()
 	}
@@ -174,7 +448,7 @@ func (l *levelIter) First() {
 func (l *levelIter) Last() {
 	// NB: the top-level dbIter will call SeekLT if IterOptions.UpperBound is
 	// set.
-	if l.loadFile(len(l.files)-1, -1) {
+	if l.loadFile(len(l.files)-1, -1, false) {
 		l.iter.Last()
 		l.skipEmptyFileBackward()
 	}
@@ -187,14 +461,14 @@ func (l *levelIter) Next() bool {
 
 	if l.iter == nil {
 		if l.boundary != nil {
-			if l.loadFile(l.index+1, 1) {
+			if l.loadFile(l.index+1, 1, true) {
 				l.iter.First()
 				l.skipEmptyFileForward()
 				return true
 			}
 			return false
 		}
-		if l.index == -1 && l.loadFile(0, 1) {
+		if l.index == -1 && l.loadFile(0, 1, true) {
 			// The iterator was positioned off the beginning of the level. Position
 			// at the first entry.
 			l.iter.First()
@@ -217,14 +491,14 @@ func (l *levelIter) Prev() bool {
 
 	if l.iter == nil {
 		if l.boundary != nil {
-			if l.loadFile(l.index-1, -1) {
+			if l.loadFile(l.index-1, -1, true) {
 				l.iter.Last()
 				l.skipEmptyFileBackward()
 				return true
 			}
 			return false
 		}
-		if n := len(l.files); l.index == n && l.loadFile(n-1, -1) {
+		if n := len(l.files); l.index == n && l.loadFile(n-1, -1, true) {
 			// The iterator was positioned off the end of the level. Position at the
 			// last entry.
 			l.iter.Last()
@@ -251,13 +525,15 @@ func (l *levelIter) skipEmptyFileForward() bool {
 			// We're being used as part of a dbIter and we've reached the end of the
 			// sstable. If the boundary is a range deletion tombstone, return that key.
 			if f := &l.files[l.index]; f.largest.Kind() == db.InternalKeyKindRangeDelete {
-				l.boundary = &f.largest
-				return true
+				if seqNum := l.opts.GetSeqNum(); seqNum == 0 || f.largest.SeqNum() <= seqNum {
+					l.boundary = &f.largest
+					return true
+				}
 			}
 		}
 
 		// Current file was exhausted. Move to the next file.
-		if !l.loadFile(l.index+1, 1) {
+		if !l.loadFile(l.index+1, 1, true) {
 			return false
 		}
 		l.iter.First()
@@ -276,13 +552,15 @@ func (l *levelIter) skipEmptyFileBackward() bool {
 			// We're being used as part of a dbIter and we've reached the end of the
 			// sstable. If the boundary is a range deletion tombstone, return that key.
 			if f := &l.files[l.index]; f.smallest.Kind() == db.InternalKeyKindRangeDelete {
-				l.boundary = &f.smallest
-				return true
+				if seqNum := l.opts.GetSeqNum(); seqNum == 0 || f.smallest.SeqNum() <= seqNum {
+					l.boundary = &f.smallest
+					return true
+				}
 			}
 		}
 
 		// Current file was exhausted. Move to the previous file.
-		if !l.loadFile(l.index-1, -1) {
+		if !l.loadFile(l.index-1, -1, true) {
 			return false
 		}
 		l.iter.Last()
@@ -322,8 +600,28 @@ func (l *levelIter) Error() error {
 }
 
 func (l *levelIter) Close() error {
+	// Unlike cancelPrefetch, Close must wait for an abandoned prefetch's
+	// iterators to actually be closed before returning, since callers rely
+	// on Close to synchronously release every resource the levelIter holds.
+	if l.prefetch != nil {
+		ch := l.prefetch
+		l.prefetch = nil
+		res := <-ch
+		if res.iter != nil {
+			if err := res.iter.Close(); err != nil && l.err == nil {
+				l.err = err
+			}
+		}
+		if res.rangeDelIter != nil {
+			if err := res.rangeDelIter.Close(); err != nil && l.err == nil {
+				l.err = err
+			}
+		}
+	}
 	if l.iter != nil {
-		l.err = l.iter.Close()
+		if err := l.iter.Close(); err != nil && l.err == nil {
+			l.err = err
+		}
 		l.iter = nil
 	}
 	return l.err
@@ -0,0 +1,111 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "github.com/petermattis/pebble/db"
+
+// Snapshot provides a read-only point-in-time view of the DB state. Its
+// sequence number is fixed at creation and every iterator derived from it
+// only ever observes keys written at or before that sequence number,
+// regardless of writes made to the DB afterwards.
+//
+// Snapshots must be closed with Close when no longer needed, both to
+// release the *Snapshot itself and, more importantly, to let compactions
+// drop keys and tombstones that only an old snapshot was keeping alive.
+type Snapshot struct {
+	db     *DB
+	seqNum uint64
+
+	// list is the snapshotList this snapshot is linked into, or nil once
+	// Close has removed it.
+	list *snapshotList
+
+	// prev, next link this snapshot into its snapshotList, in order of
+	// increasing seqNum.
+	prev, next *Snapshot
+}
+
+// Close releases the resources associated with the snapshot and removes it
+// from the DB's snapshot registry, allowing compactions to drop any keys
+// that were being kept alive only for its benefit.
+func (s *Snapshot) Close() error {
+	if s.db == nil {
+		panic("pebble: Snapshot already closed")
+	}
+	s.db.mu.Lock()
+	s.list.remove(s)
+	s.db.mu.Unlock()
+	s.db = nil
+	return nil
+}
+
+// NewIter returns an iterator over the DB's state as of the snapshot.
+func (s *Snapshot) NewIter(o *db.IterOptions) *Iterator {
+	return s.db.newIterInternal(s, o)
+}
+
+// NewSnapshot returns a point-in-time view of the current state of the DB.
+// Iterators created from the snapshot will not see subsequent writes.
+// Iterators created from the snapshot can outlive it, but the returned
+// Snapshot must be closed once it is no longer needed, since an open
+// snapshot pins the keys and tombstones it depends on and prevents
+// compactions from reclaiming them.
+func (d *DB) NewSnapshot() *Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := &Snapshot{
+		db:     d,
+		seqNum: d.mu.versions.logSeqNum,
+	}
+	d.mu.snapshots.pushBack(s)
+	return s
+}
+
+// snapshotList is an intrusive doubly-linked list of live snapshots,
+// ordered from oldest (smallest seqNum) to newest. A DB embeds one under
+// its mutex and consults oldest() during compaction to decide which
+// superseded keys and range deletion tombstones are still needed and so
+// cannot be dropped.
+type snapshotList struct {
+	root Snapshot
+}
+
+func (l *snapshotList) init() {
+	l.root.next = &l.root
+	l.root.prev = &l.root
+}
+
+func (l *snapshotList) empty() bool {
+	return l.root.next == &l.root
+}
+
+// oldest returns the sequence number of the oldest live snapshot, or
+// db.InternalKeySeqNumMax if there are none, in which case nothing need be
+// retained on a snapshot's behalf.
+func (l *snapshotList) oldest() uint64 {
+	if l.empty() {
+		return db.InternalKeySeqNumMax
+	}
+	return l.root.next.seqNum
+}
+
+func (l *snapshotList) pushBack(s *Snapshot) {
+	s.prev = l.root.prev
+	s.next = &l.root
+	s.prev.next = s
+	s.next.prev = s
+	s.list = l
+}
+
+func (l *snapshotList) remove(s *Snapshot) {
+	if s.list != l {
+		panic("pebble: snapshot list is inconsistent")
+	}
+	s.prev.next = s.next
+	s.next.prev = s.prev
+	s.next = nil
+	s.prev = nil
+	s.list = nil
+}
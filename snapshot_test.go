@@ -0,0 +1,60 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+)
+
+func TestSnapshotListOldest(t *testing.T) {
+	var l snapshotList
+	l.init()
+
+	if got := l.oldest(); got != db.InternalKeySeqNumMax {
+		t.Fatalf("oldest() on an empty list = %d, want %d", got, db.InternalKeySeqNumMax)
+	}
+
+	s1 := &Snapshot{seqNum: 10}
+	s2 := &Snapshot{seqNum: 20}
+	s3 := &Snapshot{seqNum: 30}
+	l.pushBack(s1)
+	l.pushBack(s2)
+	l.pushBack(s3)
+
+	if got := l.oldest(); got != 10 {
+		t.Fatalf("oldest() = %d, want 10", got)
+	}
+
+	// Releasing the oldest snapshot must expose the next-oldest.
+	l.remove(s1)
+	if got := l.oldest(); got != 20 {
+		t.Fatalf("oldest() after removing s1 = %d, want 20", got)
+	}
+
+	l.remove(s2)
+	l.remove(s3)
+	if !l.empty() {
+		t.Fatalf("expected list to be empty after removing all snapshots")
+	}
+	if got := l.oldest(); got != db.InternalKeySeqNumMax {
+		t.Fatalf("oldest() on a drained list = %d, want %d", got, db.InternalKeySeqNumMax)
+	}
+}
+
+func TestSnapshotListRemoveInconsistentPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected remove of a snapshot from the wrong list to panic")
+		}
+	}()
+	var l1, l2 snapshotList
+	l1.init()
+	l2.init()
+	s := &Snapshot{seqNum: 1}
+	l1.pushBack(s)
+	l2.remove(s)
+}